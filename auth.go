@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tg123/go-htpasswd"
+)
+
+// Auth validates AUTH credentials against some backend.
+type Auth interface {
+	Validate(user, pass string) bool
+	Stop()
+}
+
+// parseAuth builds an Auth backend from a URI, modelled on the scheme
+// dumbproxy uses for its own auth subsystem:
+//
+//	none://
+//	static://?username=u&password=p
+//	basicfile://?path=/etc/blackhole.htpasswd[&reload=30]
+func parseAuth(uri string) (Auth, error) {
+	u, e := url.Parse(uri)
+	if e != nil {
+		return nil, fmt.Errorf("invalid -auth URI: %w", e)
+	}
+
+	switch u.Scheme {
+	case "", "none":
+		return noneAuth{}, nil
+	case "static":
+		q := u.Query()
+		return staticAuth{
+			username: q.Get("username"),
+			password: q.Get("password"),
+		}, nil
+	case "basicfile":
+		q := u.Query()
+		path := q.Get("path")
+		if path == "" {
+			return nil, fmt.Errorf("basicfile:// auth requires a path= parameter")
+		}
+		reload := 60 * time.Second
+		if r := q.Get("reload"); r != "" {
+			secs, e := strconv.Atoi(r)
+			if e != nil {
+				return nil, fmt.Errorf("invalid reload= parameter: %w", e)
+			}
+			reload = time.Duration(secs) * time.Second
+		}
+		return newHtpasswdAuth(path, reload)
+	default:
+		return nil, fmt.Errorf("unknown -auth scheme %q", u.Scheme)
+	}
+}
+
+// noneAuth accepts any credentials, matching the blackhole's historical
+// behaviour and serving as the default.
+type noneAuth struct{}
+
+func (noneAuth) Validate(user, pass string) bool { return true }
+func (noneAuth) Stop()                           {}
+
+// staticAuth accepts a single hard-coded username/password pair.
+type staticAuth struct {
+	username string
+	password string
+}
+
+func (a staticAuth) Validate(user, pass string) bool {
+	return user == a.username && pass == a.password
+}
+func (a staticAuth) Stop() {}
+
+// htpasswdAuth validates against an htpasswd file (bcrypt/SHA/etc, via
+// go-htpasswd), reloading it periodically and on SIGHUP so credentials
+// can be rotated without restarting the blackhole.
+type htpasswdAuth struct {
+	mu   sync.RWMutex
+	file *htpasswd.File
+
+	stop chan struct{}
+}
+
+func newHtpasswdAuth(path string, reload time.Duration) (*htpasswdAuth, error) {
+	f, e := htpasswd.New(path, htpasswd.DefaultSystems, func(e error) {
+		fmt.Println("htpasswd parse error:", e)
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	a := &htpasswdAuth{
+		file: f,
+		stop: make(chan struct{}),
+	}
+
+	go a.watch(path, reload)
+
+	return a, nil
+}
+
+func (a *htpasswdAuth) watch(path string, reload time.Duration) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	var ticks <-chan time.Time
+	if reload > 0 {
+		t := time.NewTicker(reload)
+		defer t.Stop()
+		ticks = t.C
+	}
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-sighup:
+			a.reload(path)
+		case <-ticks:
+			a.reload(path)
+		}
+	}
+}
+
+func (a *htpasswdAuth) reload(path string) {
+	f, e := htpasswd.New(path, htpasswd.DefaultSystems, func(e error) {
+		fmt.Println("htpasswd parse error:", e)
+	})
+	if e != nil {
+		fmt.Println("failed to reload htpasswd file:", e)
+		return
+	}
+
+	a.mu.Lock()
+	a.file = f
+	a.mu.Unlock()
+}
+
+func (a *htpasswdAuth) Validate(user, pass string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.file.Match(user, pass)
+}
+
+func (a *htpasswdAuth) Stop() {
+	close(a.stop)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	connsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "blackhole_connections_accepted_total",
+		Help: "Total number of connections accepted.",
+	})
+	connsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "blackhole_connections_rejected_total",
+		Help: "Total number of connections rejected due to -max-conns or -rate-per-ip.",
+	})
+	connsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "blackhole_connections_in_flight",
+		Help: "Number of connections currently being handled.",
+	})
+	bytesIn = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "blackhole_bytes_in_total",
+		Help: "Total bytes read from clients.",
+	})
+	bytesOut = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "blackhole_bytes_out_total",
+		Help: "Total bytes written to clients.",
+	})
+)
+
+// serveMetrics starts a background HTTP server exposing the counters
+// above on /metrics in the Prometheus exposition format.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		if e := http.ListenAndServe(addr, mux); e != nil {
+			log.Println("metrics server stopped:", e)
+		}
+	}()
+}
+
+// meteredConn wraps a net.Conn so every byte read or written is counted
+// towards the bytesIn/bytesOut metrics.
+type meteredConn struct {
+	net.Conn
+}
+
+func (m meteredConn) Read(b []byte) (int, error) {
+	n, e := m.Conn.Read(b)
+	if n > 0 {
+		bytesIn.Add(float64(n))
+	}
+	return n, e
+}
+
+func (m meteredConn) Write(b []byte) (int, error) {
+	n, e := m.Conn.Write(b)
+	if n > 0 {
+		bytesOut.Add(float64(n))
+	}
+	return n, e
+}
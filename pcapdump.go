@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapWriter synthesizes a fake Ethernet/IPv4/TCP stream between the
+// blackhole and the connecting client so a -dump-format pcapng capture
+// can be opened directly in Wireshark for analysing broken clients.
+type pcapWriter struct {
+	w          *pcapgo.NgWriter
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	serverSeq  uint32
+	clientSeq  uint32
+}
+
+func newPCAPWriter(f *os.File, local, remote net.Addr) (*pcapWriter, error) {
+	w, e := pcapgo.NewNgWriter(f, layers.LinkTypeEthernet)
+	if e != nil {
+		return nil, e
+	}
+	return &pcapWriter{w: w, localAddr: local, remoteAddr: remote}, nil
+}
+
+// Flush pushes any packets still sitting in the NgWriter's internal
+// bufio.Writer out to the underlying file.
+func (p *pcapWriter) Flush() error {
+	return p.w.Flush()
+}
+
+// writeSegment emits one TCP segment carrying payload, flowing from the
+// client to the server (fromClient) or vice versa.
+func (p *pcapWriter) writeSegment(fromClient bool, payload []byte) error {
+	srcAddr, dstAddr := p.remoteAddr, p.localAddr
+	srcSeq, dstSeq := &p.clientSeq, &p.serverSeq
+	if !fromClient {
+		srcAddr, dstAddr = p.localAddr, p.remoteAddr
+		srcSeq, dstSeq = &p.serverSeq, &p.clientSeq
+	}
+
+	srcTCP, _ := srcAddr.(*net.TCPAddr)
+	dstTCP, _ := dstAddr.(*net.TCPAddr)
+	if srcTCP == nil || dstTCP == nil {
+		return nil
+	}
+
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    srcTCP.IP.To4(),
+		DstIP:    dstTCP.IP.To4(),
+	}
+	tcp := layers.TCP{
+		SrcPort: layers.TCPPort(srcTCP.Port),
+		DstPort: layers.TCPPort(dstTCP.Port),
+		Seq:     *srcSeq,
+		Ack:     *dstSeq,
+		ACK:     true,
+		PSH:     len(payload) > 0,
+		Window:  65535,
+	}
+	if e := tcp.SetNetworkLayerForChecksum(&ip); e != nil {
+		return e
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if e := gopacket.SerializeLayers(buf, opts, &eth, &ip, &tcp, gopacket.Payload(payload)); e != nil {
+		return e
+	}
+
+	*srcSeq += uint32(len(payload))
+
+	return p.w.WritePacket(gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(buf.Bytes()),
+		Length:        len(buf.Bytes()),
+	}, buf.Bytes())
+}
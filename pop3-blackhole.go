@@ -1,33 +1,73 @@
 package main
 
 import (
+	"bufio"
 	"crypto/tls"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type config struct {
-	latency  time.Duration
-	verbose  bool
-	servetls bool
-	tls      tls.Config
+	latency    time.Duration
+	verbose    bool
+	servetls   bool
+	tls        tls.Config
+	proto      string
+	auth       Auth
+	dumpDir    string
+	dumpFormat string
 }
 
 type handler struct {
 	s string
-	f func(*net.Conn, []byte, *config)
+	f func(c *net.Conn, r *bufio.Reader, line string, conf *config, sess *session)
 }
 
-var responses = map[string]handler{
+// session carries state that only makes sense for the lifetime of a single
+// connection, as opposed to config which is shared across all of them.
+type session struct {
+	authenticated bool
+}
+
+var pop3Responses = map[string]handler{
 	"CAPA": {"+OK Capability list follows\r\nSASL PLAIN\r\n.\r\n", nil},
 	"AUTH": {"", handleAuth},
 	"STAT": {"+OK 0 0\r\n", nil},
 	"USER": {"+OK Password required\r\n", nil},
+	"STLS": {"+OK Begin TLS negotiation\r\n", handleStarttls},
+}
+
+var smtpResponses = map[string]handler{
+	"EHLO":     {"", handleEhlo},
+	"HELO":     {"", handleHelo},
+	"MAIL":     {"250 2.1.0 OK\r\n", nil},
+	"RCPT":     {"250 2.1.5 OK\r\n", nil},
+	"DATA":     {"", handleData},
+	"RSET":     {"250 2.0.0 OK\r\n", nil},
+	"NOOP":     {"250 2.0.0 OK\r\n", nil},
+	"QUIT":     {"221 2.0.0 Bye\r\n", handleQuit},
+	"VRFY":     {"252 2.1.5 Cannot VRFY user, but will accept message and attempt delivery\r\n", nil},
+	"AUTH":     {"", handleAuth},
+	"STARTTLS": {"220 2.0.0 Ready to start TLS\r\n", handleStarttls},
+}
+
+// queueCounter feeds the fake queue IDs handed back on DATA completion.
+var queueCounter uint64
+
+func nextQueueID() string {
+	n := atomic.AddUint64(&queueCounter, 1)
+	return strings.ToUpper(fmt.Sprintf("%07x", n^uint64(time.Now().UnixNano())&0xfffffff))
 }
 
 func sendResponse(c *net.Conn, s string, verbose bool) {
@@ -42,17 +82,76 @@ func sendResponse(c *net.Conn, s string, verbose bool) {
 	}
 }
 
+// readLine reads a single CRLF (or LF) terminated line and strips the
+// trailing line ending.
+func readLine(r *bufio.Reader) (string, error) {
+	line, e := r.ReadString('\n')
+	if e != nil {
+		return "", e
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// rejectResponse is sent to connections turned away by -max-conns or
+// -rate-per-ip before the connection is closed.
+func rejectResponse(proto string) string {
+	if proto == "smtp" {
+		return "421 4.7.0 Too many connections, try again later\r\n"
+	}
+	return "-ERR Too many connections, try again later\r\n"
+}
+
+// mailVerbs requires a successful AUTH first whenever a real credential
+// check is configured (see authRequired), so a configured static:// or
+// basicfile:// backend isn't just decorative.
+var mailVerbs = map[string]bool{"MAIL": true, "RCPT": true, "DATA": true}
+
+// authRequired reports whether conf.auth enforces real credentials, as
+// opposed to noneAuth which accepts everything and shouldn't gate mail.
+func authRequired(conf *config) bool {
+	_, none := conf.auth.(noneAuth)
+	return !none
+}
+
+// authRequiredResponse is sent for MAIL/RCPT/DATA attempted before a
+// successful AUTH, when conf.auth requires one.
+func authRequiredResponse(proto string) string {
+	if proto == "smtp" {
+		return "530 5.7.0 Authentication required\r\n"
+	}
+	return "-ERR Authentication required\r\n"
+}
+
 func handleConnection(c *net.Conn, conf *config) {
 	fmt.Println("\nNew connection from", (*c).RemoteAddr().String())
 
+	*c = meteredConn{*c}
+
+	if logged, e := newSessionLogger(*c, conf); e != nil {
+		fmt.Println("Couldn't open session dump:", e)
+	} else {
+		*c = logged
+	}
+
+	responses := pop3Responses
+	banner := "+OK POP3 PROXY server ready blackhole.smtp.localhost\r\n"
+	unknown := "+OK\r\n"
+	if conf.proto == "smtp" {
+		responses = smtpResponses
+		banner = "220 blackhole.smtp.localhost ESMTP smtp-blackhole\r\n"
+		unknown = "500 5.5.2 Error: command not recognized\r\n"
+	}
+
 	// Print banner
-	sendResponse(c, "+OK POP3 PROXY server ready blackhole.smtp.localhost\r\n", conf.verbose)
+	sendResponse(c, banner, conf.verbose)
+
+	r := bufio.NewReader(*c)
+	sess := &session{}
 
 	// Handle commands
 	for {
 		// Read command
-		readBuf := make([]byte, 4096)
-		l, e := (*c).Read(readBuf)
+		line, e := readLine(r)
 		if e != nil {
 			_ = (*c).Close()
 			return
@@ -60,82 +159,297 @@ func handleConnection(c *net.Conn, conf *config) {
 
 		// Log command
 		if conf.verbose {
-			log.Printf("-> [%s]", strings.Trim(string(readBuf[0:l]), "\r\n "))
+			log.Printf("-> [%s]", line)
 		}
 
 		// Add latency
 		if conf.latency != 0 {
-			time.Sleep(conf.latency * time.Millisecond)
+			time.Sleep(conf.latency)
+		}
+
+		// Look up the verb (the first whitespace-delimited token)
+		verb := line
+		if i := strings.IndexAny(verb, " \t"); i >= 0 {
+			verb = verb[:i]
 		}
+		verb = strings.ToUpper(verb)
 
 		// Send response
-		h, ok := responses[strings.ToUpper(string(readBuf[0:4]))]
+		h, ok := responses[verb]
 		if ok {
-			sendResponse(c, h.s, conf.verbose)
+			if mailVerbs[verb] && authRequired(conf) && !sess.authenticated {
+				sendResponse(c, authRequiredResponse(conf.proto), conf.verbose)
+				continue
+			}
+			if h.s != "" {
+				sendResponse(c, h.s, conf.verbose)
+			}
 			if h.f != nil {
 				// Run callback to handle transaction
-				h.f(c, readBuf, conf)
+				h.f(c, r, line, conf, sess)
 			}
 		} else {
-			sendResponse(c, "+OK\r\n", conf.verbose)
+			sendResponse(c, unknown, conf.verbose)
 		}
 	}
 }
 
-func handleAuth(c *net.Conn, b []byte, conf *config) {
-	authLine := strings.TrimSpace(strings.Trim(string(b), "\r\n \t\000"))
+func handleEhlo(c *net.Conn, r *bufio.Reader, line string, conf *config, sess *session) {
+	sendResponse(c, "250-blackhole.smtp.localhost\r\n"+
+		"250-SIZE 35882577\r\n"+
+		"250-8BITMIME\r\n"+
+		"250-STARTTLS\r\n"+
+		"250-AUTH PLAIN LOGIN\r\n"+
+		"250 PIPELINING\r\n", conf.verbose)
+}
 
-	if authLine == "AUTH" {
-		sendResponse(c, "+OK Maildrop locked and ready\r\n", conf.verbose)
-	} else if authLine == "AUTH PLAIN" {
-		sendResponse(c, "+\r\n", conf.verbose)
+func handleHelo(c *net.Conn, r *bufio.Reader, line string, conf *config, sess *session) {
+	sendResponse(c, "250 blackhole.smtp.localhost\r\n", conf.verbose)
+}
 
-		// Read data
-		l, e := (*c).Read(b)
-		if e != nil || l == 0 {
-			fmt.Println("Couldn't read additional info for AUTH PLAIN")
+func handleData(c *net.Conn, r *bufio.Reader, line string, conf *config, sess *session) {
+	sendResponse(c, "354 Start mail input; end with <CRLF>.<CRLF>\r\n", conf.verbose)
+
+	// Consume the message body until the lone-dot terminator
+	for {
+		l, e := readLine(r)
+		if e != nil {
+			_ = (*c).Close()
 			return
 		}
+		if conf.verbose {
+			log.Printf("-> [%s]", l)
+		}
+		if l == "." {
+			break
+		}
+	}
+
+	sendResponse(c, fmt.Sprintf("250 2.0.0 OK %s\r\n", nextQueueID()), conf.verbose)
+}
+
+func handleQuit(c *net.Conn, r *bufio.Reader, line string, conf *config, sess *session) {
+	_ = (*c).Close()
+}
+
+func handleAuth(c *net.Conn, r *bufio.Reader, line string, conf *config, sess *session) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		// Bare "AUTH" with no mechanism is a syntax error, not a free pass.
+		sendResponse(c, authSyntaxError(conf), conf.verbose)
+		return
+	}
+
+	// RFC 4954: "AUTH mechanism [initial-response]" - the initial response
+	// may be inlined on the command line instead of sent as a separate
+	// continuation line, so it must be validated either way.
+	var initial string
+	if len(fields) > 2 {
+		initial = fields[2]
+	}
 
-		authLine = strings.TrimSpace(strings.Trim(string(b), "\r\n \t\000"))
+	var ok bool
+	switch strings.ToUpper(fields[1]) {
+	case "PLAIN":
+		ok = handleAuthPlain(c, r, conf, initial)
+	case "LOGIN":
+		ok = handleAuthLogin(c, r, conf, initial)
+	default:
+		// Only PLAIN and LOGIN are advertised (see handleEhlo/CAPA); reject
+		// anything else instead of defaulting to success.
+		sendResponse(c, authUnsupportedMechanism(conf), conf.verbose)
+		return
+	}
+
+	sess.authenticated = ok
+	sendResponse(c, authResult(conf, ok), conf.verbose)
+}
+
+// handleAuthPlain validates AUTH PLAIN, prompting for the initial
+// response if it wasn't inlined on the command line.
+func handleAuthPlain(c *net.Conn, r *bufio.Reader, conf *config, initial string) bool {
+	resp := initial
+	if resp == "" {
+		sendResponse(c, "+ \r\n", conf.verbose)
+
+		line, e := readLine(r)
+		if e != nil {
+			fmt.Println("Couldn't read additional info for AUTH PLAIN")
+			return false
+		}
 		if conf.verbose {
-			log.Printf("-> [%s]", authLine)
+			log.Printf("-> [%s]", line)
 		}
+		resp = line
+	}
 
-		sendResponse(c, "+OK Maildrop locked and ready\r\n", conf.verbose)
-	} else {
-		sendResponse(c, "+OK Maildrop locked and ready\r\n", conf.verbose)
+	return validatePlain(conf.auth, resp)
+}
+
+// handleAuthLogin validates AUTH LOGIN, a username/password exchange
+// where each value is sent base64 encoded on its own line (the username
+// may instead be inlined as the initial response).
+func handleAuthLogin(c *net.Conn, r *bufio.Reader, conf *config, initial string) bool {
+	user := initial
+	if user == "" {
+		sendResponse(c, "+ VXNlcm5hbWU6\r\n", conf.verbose)
+
+		line, e := readLine(r)
+		if e != nil {
+			fmt.Println("Couldn't read username for AUTH LOGIN")
+			return false
+		}
+		if conf.verbose {
+			log.Printf("-> [%s]", line)
+		}
+		user = line
+	}
+
+	sendResponse(c, "+ UGFzc3dvcmQ6\r\n", conf.verbose)
+
+	passResp, e := readLine(r)
+	if e != nil {
+		fmt.Println("Couldn't read password for AUTH LOGIN")
+		return false
+	}
+	if conf.verbose {
+		log.Printf("-> [%s]", passResp)
+	}
+
+	userDec, e1 := base64.StdEncoding.DecodeString(user)
+	passDec, e2 := base64.StdEncoding.DecodeString(passResp)
+	if e1 != nil || e2 != nil {
+		return false
+	}
+
+	return conf.auth.Validate(string(userDec), string(passDec))
+}
+
+// validatePlain decodes a SASL PLAIN initial-response/continuation
+// (authzid\0authcid\0passwd, base64 encoded) and validates the embedded
+// credentials against conf.auth.
+func validatePlain(auth Auth, b64 string) bool {
+	raw, e := base64.StdEncoding.DecodeString(b64)
+	if e != nil {
+		return false
+	}
+
+	parts := strings.SplitN(string(raw), "\x00", 3)
+	if len(parts) != 3 {
+		return false
+	}
+
+	return auth.Validate(parts[1], parts[2])
+}
+
+func authResult(conf *config, ok bool) string {
+	if conf.proto == "smtp" {
+		if ok {
+			return "235 2.7.0 Authentication successful\r\n"
+		}
+		return "535 5.7.8 Authentication failed\r\n"
+	}
+	if ok {
+		return "+OK Maildrop locked and ready\r\n"
 	}
+	return "-ERR Authentication failed\r\n"
 }
 
-func handleStarttls(c *net.Conn, b []byte, conf *config) {
-	*c = tls.Server(*c, &conf.tls)
+// authSyntaxError is sent for a bare "AUTH" with no mechanism.
+func authSyntaxError(conf *config) string {
+	if conf.proto == "smtp" {
+		return "501 5.5.4 Syntax: AUTH mechanism [initial-response]\r\n"
+	}
+	return "-ERR Syntax: AUTH mechanism [initial-response]\r\n"
+}
+
+// authUnsupportedMechanism is sent when the client asks for a SASL
+// mechanism other than the PLAIN/LOGIN we advertise and validate.
+func authUnsupportedMechanism(conf *config) string {
+	if conf.proto == "smtp" {
+		return "504 5.5.4 Unrecognized authentication type\r\n"
+	}
+	return "-ERR Unrecognized authentication type\r\n"
+}
+
+// handleStarttls upgrades the connection in place: *c and the buffered
+// reader the command loop is using are both repointed at the new TLS
+// conn, and any prior AUTH state is dropped per RFC 3207 / RFC 2595 (a
+// client must re-authenticate after negotiating TLS).
+func handleStarttls(c *net.Conn, r *bufio.Reader, line string, conf *config, sess *session) {
+	tlsConn := tls.Server(*c, &conf.tls)
+	*c = tlsConn
+	r.Reset(tlsConn)
+	sess.authenticated = false
 }
 
 func main() {
 	var conf config
-	var port, latency, cpus int
-	var certFile, keyFile string
+	var port, latency, cpus, tlsDays, maxConns, shutdownTimeout int
+	var certFile, keyFile, tlsOrg, tlsCN, authURI, metricsAddr string
+	var ratePerIP, burstPerIP float64
 
 	flag.StringVar(&certFile, "cert", "", "Certficate file (PEM encoded)")
+	flag.StringVar(&authURI, "auth", "none://", "Auth backend URI: none://, static://?username=u&password=p, or basicfile://?path=/etc/blackhole.htpasswd")
 	flag.IntVar(&cpus, "cpus", 2, "Number of CPUs/kernel threads used")
 	flag.StringVar(&keyFile, "key", "", "Private key file (PEM encoded)")
 	flag.IntVar(&latency, "latency", 0, "Latency in milliseconds")
 	flag.IntVar(&port, "port", 25, "TCP port")
+	flag.StringVar(&conf.proto, "proto", "smtp", "Protocol to speak: smtp or pop3")
 	flag.BoolVar(&conf.verbose, "verbose", false, "Show the POP3 traffic")
 	flag.BoolVar(&conf.servetls, "tls", false, "Serve TLS on the selected port (e.g. 995)")
+	flag.StringVar(&tlsOrg, "tls-org", "smtp-blackhole", "Organization name for the generated self-signed certificate")
+	flag.StringVar(&tlsCN, "tls-cn", "blackhole.smtp.localhost", "Common name for the generated self-signed certificate")
+	flag.IntVar(&tlsDays, "tls-days", 365, "Validity period (in days) for the generated self-signed certificate")
+	flag.StringVar(&conf.dumpDir, "dump-dir", "", "Directory to dump per-connection session logs into (disabled if empty)")
+	flag.StringVar(&conf.dumpFormat, "dump-format", "raw", "Session dump format: raw or pcapng")
+	flag.IntVar(&maxConns, "max-conns", 0, "Maximum number of simultaneous connections (0 = unlimited)")
+	flag.IntVar(&shutdownTimeout, "shutdown-timeout", 30, "Seconds to wait for in-flight connections to finish on shutdown")
+	flag.Float64Var(&ratePerIP, "rate-per-ip", 0, "Max new connections per second, per source IP (0 = unlimited)")
+	flag.Float64Var(&burstPerIP, "burst-per-ip", 10, "Burst size for -rate-per-ip")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on, e.g. :9090 (disabled if empty)")
 
 	flag.Parse()
 
+	// Validate dump format
+	switch conf.dumpFormat {
+	case "raw", "pcapng":
+	default:
+		log.Panicf("unknown -dump-format %q, must be raw or pcapng", conf.dumpFormat)
+		return
+	}
+
 	// Use cpus kernel threads
 	runtime.GOMAXPROCS(cpus)
 
+	// Validate protocol
+	switch conf.proto {
+	case "smtp", "pop3":
+	default:
+		log.Panicf("unknown -proto %q, must be smtp or pop3", conf.proto)
+		return
+	}
+
 	// Set latency
 	if latency < 0 || 1000000 < latency {
 		latency = 0
 	}
 	conf.latency = time.Duration(latency) * time.Millisecond
 
+	// A non-positive shutdown timeout would make the graceful shutdown
+	// below fire immediately, so fall back to the flag's default.
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = 30
+	}
+
+	// Set up the auth backend
+	auth, e := parseAuth(authURI)
+	if e != nil {
+		log.Panic(e)
+		return
+	}
+	conf.auth = auth
+
 	if certFile != "" {
 		fmt.Println("Loading TLS certs")
 		// Load certificate
@@ -150,6 +464,15 @@ func main() {
 			return
 		}
 		conf.tls.Certificates = []tls.Certificate{cert}
+	} else {
+		fmt.Println("No -cert given, generating a self-signed certificate")
+		cert, e := genSelfSignedCert.get(tlsOrg, tlsCN, tlsDays)
+		if e != nil {
+			// Error!
+			log.Panic(e)
+			return
+		}
+		conf.tls.Certificates = []tls.Certificate{cert}
 	}
 
 	// Get address:port
@@ -174,12 +497,93 @@ func main() {
 		return
 	}
 
+	if metricsAddr != "" {
+		serveMetrics(metricsAddr)
+	}
+
+	limiter := newIPRateLimiter(ratePerIP, burstPerIP, 5*time.Minute)
+
+	var sem chan struct{}
+	if maxConns > 0 {
+		sem = make(chan struct{}, maxConns)
+	}
+
+	// Close the listener and stop accepting on SIGINT/SIGTERM
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	shuttingDown := make(chan struct{})
+	go func() {
+		<-sigCh
+		fmt.Println("\nShutting down, closing listener...")
+		close(shuttingDown)
+		_ = l.Close()
+
+		// A second signal means the operator wants out now, rather than
+		// waiting out -shutdown-timeout for in-flight connections.
+		<-sigCh
+		fmt.Println("Second signal received, exiting immediately")
+		os.Exit(1)
+	}()
+
+	var wg sync.WaitGroup
+
 	// Accept connections then handle each one in a dedicated goroutine
+acceptLoop:
 	for {
 		c, e := l.Accept()
 		if e != nil {
+			select {
+			case <-shuttingDown:
+				break acceptLoop
+			default:
+				continue
+			}
+		}
+
+		if tcpAddr, ok := c.RemoteAddr().(*net.TCPAddr); ok && !limiter.Allow(tcpAddr.IP) {
+			connsRejected.Inc()
+			sendResponse(&c, rejectResponse(conf.proto), false)
+			_ = c.Close()
 			continue
 		}
-		go handleConnection(&c, &conf)
+
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			default:
+				connsRejected.Inc()
+				sendResponse(&c, rejectResponse(conf.proto), false)
+				_ = c.Close()
+				continue
+			}
+		}
+
+		connsAccepted.Inc()
+		connsInFlight.Inc()
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			defer connsInFlight.Dec()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			handleConnection(&c, &conf)
+		}(c)
 	}
+
+	// Wait for in-flight connections to finish, up to -shutdown-timeout
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		fmt.Println("All connections finished, exiting")
+	case <-time.After(time.Duration(shutdownTimeout) * time.Second):
+		fmt.Println("Shutdown timeout reached, exiting with connections still in flight")
+	}
+
+	conf.auth.Stop()
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ipRateLimiter is a token-bucket rate limiter keyed by source IP. Idle
+// buckets are swept out periodically so long-idle IPs don't leak memory.
+type ipRateLimiter struct {
+	mu      sync.RWMutex
+	buckets map[string]*tokenBucket
+	rate    float64 // tokens added per second
+	burst   float64 // bucket capacity
+	ttl     time.Duration
+}
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// newIPRateLimiter builds a limiter. A rate <= 0 disables limiting
+// entirely (Allow always returns true).
+func newIPRateLimiter(rate, burst float64, ttl time.Duration) *ipRateLimiter {
+	l := &ipRateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		rate:    rate,
+		burst:   burst,
+		ttl:     ttl,
+	}
+	if rate > 0 {
+		go l.sweep()
+	}
+	return l
+}
+
+// Allow reports whether a connection from ip should be let through,
+// consuming a token if so.
+func (l *ipRateLimiter) Allow(ip net.IP) bool {
+	if l.rate <= 0 {
+		return true
+	}
+
+	key := ip.String()
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.lastSeen).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.lastSeen = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *ipRateLimiter) sweep() {
+	t := time.NewTicker(l.ttl)
+	defer t.Stop()
+
+	for range t.C {
+		cutoff := time.Now().Add(-l.ttl)
+
+		l.mu.Lock()
+		for ip, b := range l.buckets {
+			if b.lastSeen.Before(cutoff) {
+				delete(l.buckets, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// selfSignedCert lazily generates (on first use) an in-memory self-signed
+// certificate and caches it so every connection that needs opportunistic
+// TLS reuses the same key pair instead of paying keygen cost per-handshake.
+type selfSignedCert struct {
+	once sync.Once
+	cert tls.Certificate
+	err  error
+}
+
+var genSelfSignedCert selfSignedCert
+
+func (s *selfSignedCert) get(org, cn string, days int) (tls.Certificate, error) {
+	s.once.Do(func() {
+		s.cert, s.err = generateSelfSignedCert(org, cn, days)
+	})
+	return s.cert, s.err
+}
+
+// generateSelfSignedCert creates a throwaway ECDSA key pair and a
+// self-signed certificate for it, valid for the given number of days, so
+// the blackhole can serve TLS without an operator having to supply -cert.
+func generateSelfSignedCert(org, cn string, days int) (tls.Certificate, error) {
+	priv, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		return tls.Certificate{}, e
+	}
+
+	serial, e := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if e != nil {
+		return tls.Certificate{}, e
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{org},
+			CommonName:   cn,
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(0, 0, days),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{cn},
+	}
+
+	der, e := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
+	if e != nil {
+		return tls.Certificate{}, e
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+	}, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// sessionLogger wraps a net.Conn and tees everything that passes through
+// Read/Write into a per-connection dump file, so sendResponse and the
+// command loop's Read calls don't need to know a dump is even happening.
+type sessionLogger struct {
+	net.Conn
+	raw  *os.File
+	pcap *pcapWriter
+}
+
+// newSessionLogger opens <dump-dir>/<timestamp>_<remoteaddr>.log and
+// returns a net.Conn that tees traffic into it. If conf.dumpDir is empty,
+// c is returned unwrapped.
+func newSessionLogger(c net.Conn, conf *config) (net.Conn, error) {
+	if conf.dumpDir == "" {
+		return c, nil
+	}
+
+	name := fmt.Sprintf("%s/%s_%s.log", conf.dumpDir,
+		time.Now().Format("20060102T150405.000000"),
+		sanitizeForFilename(c.RemoteAddr().String()))
+
+	f, e := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if e != nil {
+		return nil, e
+	}
+
+	sl := &sessionLogger{Conn: c, raw: f}
+
+	if conf.dumpFormat == "pcapng" {
+		pw, e := newPCAPWriter(f, c.LocalAddr(), c.RemoteAddr())
+		if e != nil {
+			_ = f.Close()
+			return nil, e
+		}
+		sl.pcap = pw
+	}
+
+	return sl, nil
+}
+
+func (s *sessionLogger) Read(b []byte) (int, error) {
+	n, e := s.Conn.Read(b)
+	if n > 0 {
+		s.dump(true, b[:n])
+	}
+	return n, e
+}
+
+func (s *sessionLogger) Write(b []byte) (int, error) {
+	n, e := s.Conn.Write(b)
+	if n > 0 {
+		s.dump(false, b[:n])
+	}
+	return n, e
+}
+
+func (s *sessionLogger) Close() error {
+	e := s.Conn.Close()
+	if s.pcap != nil {
+		// pcapgo.NgWriter buffers through an internal bufio.Writer, so the
+		// trailing packets need an explicit flush before the file closes.
+		if fe := s.pcap.Flush(); fe != nil {
+			fmt.Println("pcapng flush error:", fe)
+		}
+	}
+	_ = s.raw.Close()
+	return e
+}
+
+// dump records one Read (fromClient) or Write (!fromClient) chunk, either
+// as a synthetic pcapng TCP segment or as prefixed, timestamped text.
+func (s *sessionLogger) dump(fromClient bool, b []byte) {
+	if s.pcap != nil {
+		if e := s.pcap.writeSegment(fromClient, b); e != nil {
+			fmt.Println("pcapng dump error:", e)
+		}
+		return
+	}
+
+	prefix := "<- "
+	if fromClient {
+		prefix = "-> "
+	}
+
+	ts := time.Now().Format("2006-01-02T15:04:05.000000")
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\r\n"), "\r\n") {
+		if line == "" {
+			continue
+		}
+		fmt.Fprintf(s.raw, "%s %s%s\n", ts, prefix, line)
+	}
+}
+
+func sanitizeForFilename(s string) string {
+	return strings.NewReplacer(":", "_", "/", "_").Replace(s)
+}